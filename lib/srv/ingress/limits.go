@@ -0,0 +1,347 @@
+/*
+Copyright 2022 Gravitational, Inc.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+	http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package ingress
+
+import (
+	"fmt"
+	"net"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus"
+	"golang.org/x/time/rate"
+)
+
+const (
+	// ReasonPathConcurrency is reported when a path's
+	// MaxConcurrentPerPath cap is already at capacity.
+	ReasonPathConcurrency = "path_concurrency"
+	// ReasonPathRate is reported when a path's share of AcceptRate has
+	// no tokens left.
+	ReasonPathRate = "path_rate"
+	// ReasonRemoteIPConcurrency is reported when a remote IP's
+	// MaxConcurrentPerRemoteIP cap is already at capacity.
+	ReasonRemoteIPConcurrency = "remote_ip_concurrency"
+	// ReasonRemoteIPRate is reported when a remote IP's share of
+	// AcceptRate has no tokens left.
+	ReasonRemoteIPRate = "remote_ip_rate"
+)
+
+const (
+	// ipShardCount is the number of independent shards remote-IP state
+	// is spread across, chosen to keep contention low under concurrent
+	// Admit/Release calls without wasting much memory on mostly-idle
+	// deployments.
+	ipShardCount = 64
+	// ipSweepInterval is how often the background sweeper looks for
+	// idle per-remote-IP buckets to evict.
+	ipSweepInterval = time.Minute
+	// ipIdleTimeout is how long a remote IP can sit with no concurrent
+	// connections before its bucket (and rate limiter) is evicted.
+	ipIdleTimeout = 10 * time.Minute
+)
+
+// RateLimit configures a token-bucket accept rate. The zero value
+// disables rate limiting.
+type RateLimit struct {
+	// Rate is the steady-state number of accepted connections allowed
+	// per second.
+	Rate rate.Limit
+	// Burst is the largest number of connections allowed through in a
+	// single instant, on top of the steady-state Rate.
+	Burst int
+}
+
+// Limits configures the caps Reporter.Admit enforces. The zero value
+// enforces nothing, making Admit behave exactly like ConnectionAccepted.
+type Limits struct {
+	// MaxConcurrentPerPath caps the number of simultaneously active
+	// connections for each named ingress path (see the Path constants).
+	// A path with no entry is unlimited.
+	MaxConcurrentPerPath map[string]int
+	// MaxConcurrentPerRemoteIP caps the number of simultaneously active
+	// connections from a single remote IP, across all paths and
+	// services. Zero means unlimited.
+	MaxConcurrentPerRemoteIP int
+	// AcceptRate, if non-zero, is applied independently to each path
+	// and to each remote IP, so one noisy path or client can't exhaust
+	// the accept budget of the others.
+	AcceptRate RateLimit
+}
+
+// ErrIngressLimitExceeded is returned by Admit when conn would put its
+// path or its remote IP over one of Limits' caps or rate limits.
+type ErrIngressLimitExceeded struct {
+	Path, Service, Reason string
+}
+
+func (e *ErrIngressLimitExceeded) Error() string {
+	return fmt.Sprintf("ingress limit exceeded for service %q via %q path (%s)", e.Service, e.Path, e.Reason)
+}
+
+var ingressRejectedTotal = prometheus.NewCounterVec(
+	prometheus.CounterOpts{
+		Name: "teleport_ingress_rejected_total",
+		Help: "Number of ingress connections rejected by Reporter.Admit, by path, service and reason",
+	},
+	[]string{"path", "service", "reason"},
+)
+
+var registerLimitMetricsOnce sync.Once
+
+// registerLimitMetrics registers ingressRejectedTotal. It is called
+// lazily from NewReporter rather than from init so that processes which
+// never configure Limits still only pay for counter registration once a
+// Reporter actually exists.
+func registerLimitMetrics() {
+	registerLimitMetricsOnce.Do(func() {
+		prometheus.MustRegister(ingressRejectedTotal)
+	})
+}
+
+// WithLimits configures limits for Admit and Release to enforce. Without
+// this option a Reporter enforces nothing.
+func WithLimits(limits Limits) ReporterOption {
+	return func(r *Reporter) {
+		r.limits = limits
+
+		r.pathCounters = make(map[string]*int64, len(limits.MaxConcurrentPerPath))
+		for path := range limits.MaxConcurrentPerPath {
+			r.pathCounters[path] = new(int64)
+		}
+
+		if limits.MaxConcurrentPerRemoteIP > 0 || limits.AcceptRate.Rate > 0 {
+			r.remoteIPs = newIPShardedMap()
+			stop := make(chan struct{})
+			var closeOnce sync.Once
+			go r.remoteIPs.sweepLoop(ipSweepInterval, ipIdleTimeout, stop)
+			r.closeSweeper = func() { closeOnce.Do(func() { close(stop) }) }
+		}
+	}
+}
+
+// pathLimiter returns the shared token-bucket limiter for path, creating
+// it the first time path is seen. Paths are a small, effectively fixed
+// set (see the Path constants), so a sync.Map comfortably keeps this off
+// the hot path without needing its own sharding.
+func (r *Reporter) pathLimiter(path string) *rate.Limiter {
+	if v, ok := r.pathLimiters.Load(path); ok {
+		return v.(*rate.Limiter)
+	}
+	limiter := rate.NewLimiter(r.limits.AcceptRate.Rate, r.limits.AcceptRate.Burst)
+	actual, _ := r.pathLimiters.LoadOrStore(path, limiter)
+	return actual.(*rate.Limiter)
+}
+
+// admitPath atomically reserves a concurrency slot for path if
+// MaxConcurrentPerPath caps it, returning false without reserving
+// anything if the cap is already reached. Unlimited (or unconfigured)
+// paths always succeed.
+func (r *Reporter) admitPath(path string) bool {
+	counter, ok := r.pathCounters[path]
+	if !ok {
+		return true
+	}
+	if atomic.AddInt64(counter, 1) > int64(r.limits.MaxConcurrentPerPath[path]) {
+		atomic.AddInt64(counter, -1)
+		return false
+	}
+	return true
+}
+
+func (r *Reporter) releasePath(path string) {
+	if counter, ok := r.pathCounters[path]; ok {
+		atomic.AddInt64(counter, -1)
+	}
+}
+
+// Admit is ConnectionAccepted, but first checks conn against the
+// Reporter's configured Limits, atomically reserving the concurrency
+// slots it consumes. If any cap or rate limit would be exceeded it
+// increments ingress_rejected_total and returns an
+// *ErrIngressLimitExceeded without updating any of the accepted/active
+// gauges ConnectionAccepted would have.
+func (r *Reporter) Admit(service string, conn net.Conn) error {
+	path := r.getIngressPath(conn)
+
+	if !r.admitPath(path) {
+		ingressRejectedTotal.WithLabelValues(path, service, ReasonPathConcurrency).Inc()
+		return &ErrIngressLimitExceeded{Path: path, Service: service, Reason: ReasonPathConcurrency}
+	}
+	if r.limits.AcceptRate.Rate > 0 && !r.pathLimiter(path).Allow() {
+		r.releasePath(path)
+		ingressRejectedTotal.WithLabelValues(path, service, ReasonPathRate).Inc()
+		return &ErrIngressLimitExceeded{Path: path, Service: service, Reason: ReasonPathRate}
+	}
+
+	var bucket *ipBucket
+	if r.remoteIPs != nil {
+		bucket = r.remoteIPs.bucketFor(remoteIP(conn), r.limits.AcceptRate)
+
+		if !bucket.admit(r.limits.MaxConcurrentPerRemoteIP) {
+			r.releasePath(path)
+			ingressRejectedTotal.WithLabelValues(path, service, ReasonRemoteIPConcurrency).Inc()
+			return &ErrIngressLimitExceeded{Path: path, Service: service, Reason: ReasonRemoteIPConcurrency}
+		}
+		if r.limits.AcceptRate.Rate > 0 && !bucket.limiter.Allow() {
+			bucket.release()
+			r.releasePath(path)
+			ingressRejectedTotal.WithLabelValues(path, service, ReasonRemoteIPRate).Inc()
+			return &ErrIngressLimitExceeded{Path: path, Service: service, Reason: ReasonRemoteIPRate}
+		}
+	}
+
+	r.ConnectionAccepted(service, conn)
+	return nil
+}
+
+// Release is ConnectionClosed, but additionally frees the concurrency
+// slots a matching, successful Admit call reserved for conn.
+func (r *Reporter) Release(service string, conn net.Conn) {
+	r.releasePath(r.getIngressPath(conn))
+	if r.remoteIPs != nil {
+		r.remoteIPs.release(remoteIP(conn))
+	}
+	r.ConnectionClosed(service, conn)
+}
+
+// remoteIP returns the host portion of conn's remote address, falling
+// back to the address verbatim if it carries no port to split off.
+func remoteIP(conn net.Conn) string {
+	addr := conn.RemoteAddr()
+	if addr == nil {
+		return ""
+	}
+	host, _, err := net.SplitHostPort(addr.String())
+	if err != nil {
+		return addr.String()
+	}
+	return host
+}
+
+// ipBucket tracks the concurrency count and rate limiter for a single
+// remote IP.
+type ipBucket struct {
+	concurrent int64 // accessed atomically
+	limiter    *rate.Limiter
+	lastSeen   int64 // unix nanoseconds, accessed atomically
+}
+
+func (b *ipBucket) touch() {
+	atomic.StoreInt64(&b.lastSeen, time.Now().UnixNano())
+}
+
+// admit reserves a concurrency slot, returning false without reserving
+// one if max is positive and already reached. max<=0 means unlimited.
+func (b *ipBucket) admit(max int) bool {
+	b.touch()
+	if atomic.AddInt64(&b.concurrent, 1) > int64(max) && max > 0 {
+		atomic.AddInt64(&b.concurrent, -1)
+		return false
+	}
+	return true
+}
+
+func (b *ipBucket) release() {
+	atomic.AddInt64(&b.concurrent, -1)
+}
+
+func (b *ipBucket) idle(now time.Time, idleTimeout time.Duration) bool {
+	return atomic.LoadInt64(&b.concurrent) == 0 &&
+		now.Sub(time.Unix(0, atomic.LoadInt64(&b.lastSeen))) > idleTimeout
+}
+
+// ipShard is one shard of an ipShardedMap: a sync.Map gives lock-free
+// reads for IPs already seen, so Admit/Release only take a lock on the
+// rare miss that creates a new bucket.
+type ipShard struct {
+	buckets sync.Map // string -> *ipBucket
+}
+
+// ipShardedMap is a sharded, keyed-by-remote-IP set of ipBuckets. Reads
+// and writes for different IPs land on independent shards, and within a
+// shard the hot-path operations (admit/release/touch) are lock-free
+// atomic updates to an already-created bucket.
+type ipShardedMap struct {
+	shards [ipShardCount]*ipShard
+}
+
+func newIPShardedMap() *ipShardedMap {
+	m := &ipShardedMap{}
+	for i := range m.shards {
+		m.shards[i] = &ipShard{}
+	}
+	return m
+}
+
+func (m *ipShardedMap) shardFor(ip string) *ipShard {
+	var h uint32
+	for i := 0; i < len(ip); i++ {
+		h = h*31 + uint32(ip[i])
+	}
+	return m.shards[h%ipShardCount]
+}
+
+// bucketFor returns ip's bucket, creating it (with a rate limiter
+// configured from acceptRate, if set) the first time ip is seen.
+func (m *ipShardedMap) bucketFor(ip string, acceptRate RateLimit) *ipBucket {
+	shard := m.shardFor(ip)
+	if v, ok := shard.buckets.Load(ip); ok {
+		return v.(*ipBucket)
+	}
+	b := &ipBucket{}
+	if acceptRate.Rate > 0 {
+		b.limiter = rate.NewLimiter(acceptRate.Rate, acceptRate.Burst)
+	}
+	actual, _ := shard.buckets.LoadOrStore(ip, b)
+	return actual.(*ipBucket)
+}
+
+func (m *ipShardedMap) release(ip string) {
+	if v, ok := m.shardFor(ip).buckets.Load(ip); ok {
+		v.(*ipBucket).release()
+	}
+}
+
+// sweepLoop periodically evicts buckets that have had no concurrent
+// connections for longer than idleTimeout, until stop is closed. It is
+// meant to run in its own goroutine, started by WithLimits.
+func (m *ipShardedMap) sweepLoop(interval, idleTimeout time.Duration, stop <-chan struct{}) {
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-ticker.C:
+			m.sweep(idleTimeout)
+		case <-stop:
+			return
+		}
+	}
+}
+
+func (m *ipShardedMap) sweep(idleTimeout time.Duration) {
+	now := time.Now()
+	for _, shard := range m.shards {
+		shard.buckets.Range(func(key, value interface{}) bool {
+			if value.(*ipBucket).idle(now, idleTimeout) {
+				shard.buckets.Delete(key)
+			}
+			return true
+		})
+	}
+}
@@ -0,0 +1,124 @@
+/*
+Copyright 2022 Gravitational, Inc.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+	http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package ingress
+
+import (
+	"net"
+	"testing"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus"
+	prommodel "github.com/prometheus/client_model/go"
+	"github.com/stretchr/testify/require"
+	"golang.org/x/time/rate"
+)
+
+const testPath = "test_path"
+
+// testPathDetector is a WithPathDetector detector that classifies every
+// connection as testPath, decoupling these tests from the port-based
+// classification rules getIngressPath otherwise applies.
+func testPathDetector(net.Conn) (string, bool) {
+	return testPath, true
+}
+
+type fakeConn struct {
+	net.Conn
+	local, remote net.Addr
+}
+
+func (c *fakeConn) LocalAddr() net.Addr  { return c.local }
+func (c *fakeConn) RemoteAddr() net.Addr { return c.remote }
+
+func newFakeConn(t *testing.T, remoteAddr string) net.Conn {
+	addr, err := net.ResolveTCPAddr("tcp", remoteAddr)
+	require.NoError(t, err)
+	return &fakeConn{remote: addr}
+}
+
+func TestAdmitPathConcurrency(t *testing.T) {
+	reporter, err := NewReporter("", WithPathDetector(testPathDetector), WithLimits(Limits{
+		MaxConcurrentPerPath: map[string]int{testPath: 1},
+	}))
+	require.NoError(t, err)
+	t.Cleanup(func() { ingressRejectedTotal.Reset() })
+
+	first := newFakeConn(t, "10.0.0.1:1111")
+	require.NoError(t, reporter.Admit(Web, first))
+
+	second := newFakeConn(t, "10.0.0.2:2222")
+	err = reporter.Admit(Web, second)
+	require.Error(t, err)
+	limitErr, ok := err.(*ErrIngressLimitExceeded)
+	require.True(t, ok)
+	require.Equal(t, ReasonPathConcurrency, limitErr.Reason)
+	require.Equal(t, 1, getCounterValue3(ingressRejectedTotal, testPath, Web, ReasonPathConcurrency))
+
+	reporter.Release(Web, first)
+	require.NoError(t, reporter.Admit(Web, second))
+}
+
+func TestAdmitRemoteIPConcurrency(t *testing.T) {
+	reporter, err := NewReporter("", WithPathDetector(testPathDetector), WithLimits(Limits{
+		MaxConcurrentPerRemoteIP: 1,
+	}))
+	require.NoError(t, err)
+	t.Cleanup(func() { ingressRejectedTotal.Reset(); reporter.Close() })
+
+	firstFromA := newFakeConn(t, "10.0.0.1:1111")
+	require.NoError(t, reporter.Admit(Web, firstFromA))
+
+	secondFromA := newFakeConn(t, "10.0.0.1:2222")
+	err = reporter.Admit(Web, secondFromA)
+	require.Error(t, err)
+	limitErr, ok := err.(*ErrIngressLimitExceeded)
+	require.True(t, ok)
+	require.Equal(t, ReasonRemoteIPConcurrency, limitErr.Reason)
+
+	fromB := newFakeConn(t, "10.0.0.2:1111")
+	require.NoError(t, reporter.Admit(Web, fromB))
+
+	reporter.Release(Web, firstFromA)
+	require.NoError(t, reporter.Admit(Web, secondFromA))
+}
+
+func TestAdmitAcceptRate(t *testing.T) {
+	reporter, err := NewReporter("", WithPathDetector(testPathDetector), WithLimits(Limits{
+		AcceptRate: RateLimit{Rate: rate.Every(time.Hour), Burst: 1},
+	}))
+	require.NoError(t, err)
+	t.Cleanup(func() { ingressRejectedTotal.Reset(); reporter.Close() })
+
+	first := newFakeConn(t, "10.0.0.1:1111")
+	require.NoError(t, reporter.Admit(Web, first))
+	reporter.Release(Web, first)
+
+	second := newFakeConn(t, "10.0.0.1:2222")
+	err = reporter.Admit(Web, second)
+	require.Error(t, err)
+	limitErr, ok := err.(*ErrIngressLimitExceeded)
+	require.True(t, ok)
+	require.Equal(t, ReasonPathRate, limitErr.Reason)
+}
+
+func getCounterValue3(metric *prometheus.CounterVec, path, service, reason string) int {
+	m := &prommodel.Metric{}
+	if err := metric.WithLabelValues(path, service, reason).Write(m); err != nil {
+		return 0
+	}
+	return int(m.Counter.GetValue())
+}
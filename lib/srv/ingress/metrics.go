@@ -0,0 +1,246 @@
+/*
+Copyright 2022 Gravitational, Inc.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+	http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package ingress
+
+import (
+	"net"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus"
+)
+
+// ReporterConfig configures the bucket boundaries Reporter uses for its
+// latency and byte-throughput histograms. The zero value is not usable;
+// construct one with DefaultReporterConfig and override fields as needed.
+type ReporterConfig struct {
+	// DurationBuckets bounds the ingress_connection_duration_seconds
+	// histogram. Defaults run from 100µs to 60s; connections open longer
+	// than 60s, such as long-lived SSH sessions, all fall in the +Inf
+	// bucket.
+	DurationBuckets []float64
+	// ByteBuckets bounds the per-connection bytes-transferred histograms.
+	// Defaults span an empty handshake up to a large file transfer.
+	ByteBuckets []float64
+}
+
+// DefaultReporterConfig returns the bucket boundaries used when a Reporter
+// is constructed without an explicit WithConfig option: exponential from
+// 100µs to 60s for connection duration, and 1KB to 1GB for bytes
+// transferred.
+func DefaultReporterConfig() ReporterConfig {
+	return ReporterConfig{
+		DurationBuckets: prometheus.ExponentialBucketsRange(0.0001, 60, 20),
+		ByteBuckets:     prometheus.ExponentialBucketsRange(1024, 1024*1024*1024, 20),
+	}
+}
+
+var (
+	connectionDuration *prometheus.HistogramVec
+
+	bytesReadTotal    *prometheus.CounterVec
+	bytesWrittenTotal *prometheus.CounterVec
+
+	connectionBytesRead    *prometheus.HistogramVec
+	connectionBytesWritten *prometheus.HistogramVec
+)
+
+var registerThroughputMetricsOnce sync.Once
+
+// registerThroughputMetrics registers the latency/byte-throughput metric
+// vectors using cfg's bucket boundaries. It is called lazily from
+// NewReporter, with WithConfig's cfg if the caller supplied one, rather
+// than from init, because Prometheus fixes histogram buckets at
+// registration: once the first Reporter in the process has been
+// constructed, later calls, even with a different cfg, are no-ops.
+func registerThroughputMetrics(cfg ReporterConfig) {
+	registerThroughputMetricsOnce.Do(func() {
+		connectionDuration = prometheus.NewHistogramVec(
+			prometheus.HistogramOpts{
+				Name:    "teleport_ingress_connection_duration_seconds",
+				Help:    "Duration of ingress connections, by path, service and whether they authenticated",
+				Buckets: cfg.DurationBuckets,
+			},
+			[]string{"path", "service", "authenticated"},
+		)
+		bytesReadTotal = prometheus.NewCounterVec(
+			prometheus.CounterOpts{
+				Name: "teleport_ingress_bytes_read_total",
+				Help: "Bytes read from ingress connections, by path and service",
+			},
+			[]string{"path", "service"},
+		)
+		bytesWrittenTotal = prometheus.NewCounterVec(
+			prometheus.CounterOpts{
+				Name: "teleport_ingress_bytes_written_total",
+				Help: "Bytes written to ingress connections, by path and service",
+			},
+			[]string{"path", "service"},
+		)
+		connectionBytesRead = prometheus.NewHistogramVec(
+			prometheus.HistogramOpts{
+				Name:    "teleport_ingress_connection_bytes_read",
+				Help:    "Bytes read per ingress connection, by path and service",
+				Buckets: cfg.ByteBuckets,
+			},
+			[]string{"path", "service"},
+		)
+		connectionBytesWritten = prometheus.NewHistogramVec(
+			prometheus.HistogramOpts{
+				Name:    "teleport_ingress_connection_bytes_written",
+				Help:    "Bytes written per ingress connection, by path and service",
+				Buckets: cfg.ByteBuckets,
+			},
+			[]string{"path", "service"},
+		)
+		prometheus.MustRegister(
+			connectionDuration,
+			bytesReadTotal,
+			bytesWrittenTotal,
+			connectionBytesRead,
+			connectionBytesWritten,
+		)
+	})
+}
+
+// WithConfig sets the bucket boundaries Reporter uses for its latency and
+// byte-throughput histograms. It only has an effect the first time any
+// Reporter in the process is constructed, since Prometheus fixes
+// histogram buckets at registration; later Reporters silently reuse
+// whichever buckets were registered first.
+func WithConfig(cfg ReporterConfig) ReporterOption {
+	return func(r *Reporter) {
+		registerThroughputMetrics(cfg)
+	}
+}
+
+// countingConn wraps an accepted net.Conn, tracking bytes read, bytes
+// written and whether it authenticated, so ConnectionAcceptedConn and
+// WrapListener can populate the latency/throughput metrics once it
+// closes.
+type countingConn struct {
+	net.Conn
+	path, service string
+	start         time.Time
+
+	read          uint64
+	written       uint64
+	authenticated int32
+
+	closeOnce sync.Once
+}
+
+func (c *countingConn) Read(p []byte) (int, error) {
+	n, err := c.Conn.Read(p)
+	atomic.AddUint64(&c.read, uint64(n))
+	return n, err
+}
+
+func (c *countingConn) Write(p []byte) (int, error) {
+	n, err := c.Conn.Write(p)
+	atomic.AddUint64(&c.written, uint64(n))
+	return n, err
+}
+
+// SetAuthenticated records that the connection completed authentication,
+// so its duration is reported with authenticated="true" once it closes.
+func (c *countingConn) SetAuthenticated() {
+	atomic.StoreInt32(&c.authenticated, 1)
+}
+
+// Unwrap returns the connection countingConn wraps, so callers that
+// type-assert for a specific underlying connection, such as
+// getIngressPath's PROXY protocol detection, still see it after
+// WrapListener or ConnectionAcceptedConn has wrapped it for throughput
+// accounting.
+func (c *countingConn) Unwrap() net.Conn {
+	return c.Conn
+}
+
+func (c *countingConn) Close() error {
+	err := c.Conn.Close()
+	c.closeOnce.Do(func() {
+		read := atomic.LoadUint64(&c.read)
+		written := atomic.LoadUint64(&c.written)
+		bytesReadTotal.WithLabelValues(c.path, c.service).Add(float64(read))
+		bytesWrittenTotal.WithLabelValues(c.path, c.service).Add(float64(written))
+		connectionBytesRead.WithLabelValues(c.path, c.service).Observe(float64(read))
+		connectionBytesWritten.WithLabelValues(c.path, c.service).Observe(float64(written))
+
+		authenticated := "false"
+		if atomic.LoadInt32(&c.authenticated) != 0 {
+			authenticated = "true"
+		}
+		connectionDuration.WithLabelValues(c.path, c.service, authenticated).Observe(time.Since(c.start).Seconds())
+	})
+	return err
+}
+
+// authenticator is implemented by connections wrapped with
+// ConnectionAcceptedConn or WrapListener, letting HTTPConnStateReporter
+// mark one as authenticated without needing to hold onto the wrapper
+// itself.
+type authenticator interface {
+	SetAuthenticated()
+}
+
+// ConnectionAcceptedConn is ConnectionAccepted, but additionally wraps
+// conn in a shim that tracks bytes read/written and connection duration,
+// returning it so the caller can substitute it for the raw accepted
+// connection before handing it off to its protocol handler. Callers that
+// cannot swap the connection they hand off, such as an http.Server that
+// owns the net.Conn its Listener returned, should wrap the Listener
+// itself instead; see WrapListener.
+func (r *Reporter) ConnectionAcceptedConn(service string, conn net.Conn) net.Conn {
+	r.ConnectionAccepted(service, conn)
+	return &countingConn{
+		Conn:    conn,
+		path:    r.getIngressPath(conn),
+		service: service,
+		start:   time.Now(),
+	}
+}
+
+// countingListener wraps a net.Listener so every connection it accepts is
+// already wrapped with the byte/duration accounting countingConn
+// performs, letting servers that own their connections (like
+// http.Server) get throughput metrics without touching handler code.
+type countingListener struct {
+	net.Listener
+	reporter *Reporter
+	service  string
+}
+
+// WrapListener returns a net.Listener whose Accept returns connections
+// already wrapped for byte and duration accounting under service.
+func (r *Reporter) WrapListener(listener net.Listener, service string) net.Listener {
+	return &countingListener{Listener: listener, reporter: r, service: service}
+}
+
+func (l *countingListener) Accept() (net.Conn, error) {
+	conn, err := l.Listener.Accept()
+	if err != nil {
+		return nil, err
+	}
+	return &countingConn{
+		Conn:    conn,
+		path:    l.reporter.getIngressPath(conn),
+		service: l.service,
+		start:   time.Now(),
+	}, nil
+}
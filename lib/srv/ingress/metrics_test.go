@@ -0,0 +1,92 @@
+/*
+Copyright 2022 Gravitational, Inc.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+	http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package ingress
+
+import (
+	"io"
+	"net"
+	"net/http"
+	"testing"
+
+	"github.com/prometheus/client_golang/prometheus"
+	prommodel "github.com/prometheus/client_model/go"
+	"github.com/stretchr/testify/require"
+)
+
+// TestHTTPConnStateReporterThroughput is TestHTTPConnStateReporter, but
+// exercises a Listener wrapped with Reporter.WrapListener, asserting that
+// HTTPConnStateReporter populates the byte and duration metrics with no
+// changes to the handler.
+func TestHTTPConnStateReporterThroughput(t *testing.T) {
+	reporter, err := NewReporter("")
+	require.NoError(t, err)
+
+	l, err := net.Listen("tcp", "localhost:0")
+	require.NoError(t, err)
+
+	stateC := make(chan http.ConnState, 2)
+	reporterFunc := HTTPConnStateReporter(Web, reporter)
+
+	handler := http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Write([]byte("hello"))
+	})
+	s := http.Server{
+		Handler: handler,
+		ConnState: func(c net.Conn, state http.ConnState) {
+			reporterFunc(c, state)
+			if state == http.StateNew || state == http.StateClosed {
+				stateC <- state
+			}
+		},
+	}
+
+	go s.Serve(reporter.WrapListener(l, Web))
+	t.Cleanup(func() { require.NoError(t, s.Close()) })
+	t.Cleanup(func() {
+		connectionDuration.Reset()
+		bytesReadTotal.Reset()
+		bytesWrittenTotal.Reset()
+		connectionBytesRead.Reset()
+		connectionBytesWritten.Reset()
+	})
+
+	resp, err := http.Get("http://" + l.Addr().String())
+	require.NoError(t, err)
+	body, err := io.ReadAll(resp.Body)
+	require.NoError(t, err)
+	require.Equal(t, "hello", string(body))
+	require.NoError(t, resp.Body.Close())
+
+	state := <-stateC
+	require.Equal(t, http.StateNew, state)
+
+	http.DefaultClient.CloseIdleConnections()
+	state = <-stateC
+	require.Equal(t, http.StateClosed, state)
+
+	require.Equal(t, 1, getHistogramSampleCount(connectionDuration, PathDirect, Web, "true"))
+	require.Greater(t, getCounterValue(bytesReadTotal, PathDirect, Web), 0)
+	require.Greater(t, getCounterValue(bytesWrittenTotal, PathDirect, Web), 0)
+}
+
+func getHistogramSampleCount(metric *prometheus.HistogramVec, labelValues ...string) int {
+	m := &prommodel.Metric{}
+	if err := metric.WithLabelValues(labelValues...).(prometheus.Metric).Write(m); err != nil {
+		return 0
+	}
+	return int(m.Histogram.GetSampleCount())
+}
@@ -0,0 +1,406 @@
+/*
+Copyright 2022 Gravitational, Inc.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+	http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package ingress
+
+import (
+	"bufio"
+	"encoding/binary"
+	"fmt"
+	"io"
+	"net"
+	"sync"
+	"time"
+
+	"github.com/gravitational/trace"
+	"github.com/prometheus/client_golang/prometheus"
+)
+
+// headerReadTimeout bounds how long readHeader will wait for a PROXY
+// protocol header (or enough bytes to rule one out) before giving up on
+// conn. Without this, a client that opens a connection and never sends
+// anything would block Accept's single accept loop forever, stalling
+// every other connection on the listener.
+const headerReadTimeout = 5 * time.Second
+
+// PathProxyProtocol is used for connections whose real client address and
+// ingress metadata were recovered from a HAProxy PROXY protocol header
+// rather than inferred from the listener they arrived on.
+const PathProxyProtocol = "proxy_protocol"
+
+// Teleport-assigned PROXY protocol v2 TLV types. These live in the
+// private-use range (0xE0-0xEF) reserved by the spec for application
+// specific data.
+const (
+	// tlvTypeIngressPath carries the ingress path label (e.g. "alpn",
+	// "direct") that the upstream load balancer determined for this
+	// connection.
+	tlvTypeIngressPath = 0xE0
+	// tlvTypeTrustDomain carries the trust domain of the cluster that
+	// terminated the PROXY protocol connection, when it differs from the
+	// cluster accepting it (e.g. a leaf cluster dialing through a root
+	// proxy).
+	tlvTypeTrustDomain = 0xE1
+)
+
+// Minimum v2 address-block lengths for the address families this package
+// understands, per the PROXY protocol v2 spec: 2 IPv4 addresses plus 2
+// ports, or 2 IPv6 addresses plus 2 ports. A header whose wire-supplied
+// addrLen is shorter than its declared family requires is malformed.
+const (
+	minAddrLenIPv4 = 12
+	minAddrLenIPv6 = 36
+)
+
+// maxTrustDomainLen bounds how much of a tlvTypeTrustDomain value
+// parseTeleportTLVs will accept into proxyProtocolMeta, so a connection
+// from an untrusted or misconfigured source can't use an oversized TLV
+// value (up to 64KB, per the TLV length field) to inflate a Prometheus
+// label. This is a length cap only; ProxyProtocolListener.TrustDomains
+// additionally restricts values to a known set.
+const maxTrustDomainLen = 255
+
+var (
+	proxyProtocolRejected = prometheus.NewCounterVec(
+		prometheus.CounterOpts{
+			Name: "teleport_proxy_protocol_rejected_total",
+			Help: "Number of connections carrying a PROXY protocol header that were rejected, because the listener does not allow it from that source or because the header could not be read",
+		},
+		[]string{"service"},
+	)
+
+	// acceptedConnectionsByTrustDomain and activeConnectionsByTrustDomain
+	// are parallel vectors carrying the extra trust_domain label. They are
+	// only populated for connections whose PROXY protocol v2 header carried
+	// the Teleport trust domain TLV, so enabling the feature never changes
+	// the cardinality of the existing acceptedConnections/activeConnections
+	// vectors that other scrapers already depend on.
+	acceptedConnectionsByTrustDomain = prometheus.NewCounterVec(
+		prometheus.CounterOpts{
+			Name: "teleport_connections_accepted_by_trust_domain_total",
+			Help: "Number of connections accepted by Teleport, by ingress path, service and PROXY protocol trust domain",
+		},
+		[]string{"path", "service", "trust_domain"},
+	)
+	activeConnectionsByTrustDomain = prometheus.NewGaugeVec(
+		prometheus.GaugeOpts{
+			Name: "teleport_connections_active_by_trust_domain",
+			Help: "Number of currently active connections, by ingress path, service and PROXY protocol trust domain",
+		},
+		[]string{"path", "service", "trust_domain"},
+	)
+)
+
+var registerTrustDomainMetricsOnce sync.Once
+
+// registerTrustDomainMetrics registers the trust-domain-labeled parallel
+// metric vectors. It is called lazily from NewProxyProtocolListener rather
+// than from init, so that clusters which never enable PROXY protocol
+// support never pay for the extra label cardinality, and existing
+// scrapers of acceptedConnections/activeConnections see no change.
+func registerTrustDomainMetrics() {
+	registerTrustDomainMetricsOnce.Do(func() {
+		prometheus.MustRegister(acceptedConnectionsByTrustDomain, activeConnectionsByTrustDomain)
+	})
+}
+
+func init() {
+	prometheus.MustRegister(proxyProtocolRejected)
+}
+
+// proxyProtocolMeta is the Teleport-specific metadata recovered from a
+// PROXY protocol v2 header's TLVs, if any were present.
+type proxyProtocolMeta struct {
+	ingressPath string
+	trustDomain string
+}
+
+// proxyProtocolConn wraps a connection accepted with a PROXY protocol
+// header, replacing RemoteAddr with the original client address and
+// exposing any Teleport TLV metadata that came with it.
+type proxyProtocolConn struct {
+	net.Conn
+	remoteAddr net.Addr
+	localAddr  net.Addr
+	meta       proxyProtocolMeta
+}
+
+func (c *proxyProtocolConn) RemoteAddr() net.Addr {
+	if c.remoteAddr != nil {
+		return c.remoteAddr
+	}
+	return c.Conn.RemoteAddr()
+}
+
+func (c *proxyProtocolConn) LocalAddr() net.Addr {
+	if c.localAddr != nil {
+		return c.localAddr
+	}
+	return c.Conn.LocalAddr()
+}
+
+// ProxyProtocolListener wraps a net.Listener, recognizing connections that
+// begin with a HAProxy PROXY protocol v1 or v2 header and rewriting their
+// RemoteAddr/LocalAddr to the original client/destination addresses that
+// the header carries. Connections from sources not present in AllowFrom
+// are passed through unmodified unless they begin with a header anyway,
+// in which case the connection is rejected and proxyProtocolRejected is
+// incremented.
+type ProxyProtocolListener struct {
+	net.Listener
+
+	// Service identifies the Teleport service this listener serves, used
+	// to label proxyProtocolRejected.
+	Service string
+	// AllowFrom restricts which source addresses are trusted to prepend a
+	// PROXY protocol header. Connections from any other source are passed
+	// through unmodified unless they attempt to send a header, in which
+	// case they are rejected.
+	AllowFrom []*net.IPNet
+	// TrustDomains, if non-empty, restricts the trust domain TLV accepted
+	// from a header to this set. A header carrying any other value has it
+	// discarded, as though the TLV were absent, rather than passing it
+	// through to the acceptedConnectionsByTrustDomain/
+	// activeConnectionsByTrustDomain labels: AllowFrom only vouches for a
+	// source being allowed to send a header at all, not for the values it
+	// puts in one, so a misconfigured or spoofed source could otherwise
+	// mint an unbounded number of Prometheus label series by sending a
+	// distinct trust domain per connection. Leaving this empty accepts
+	// any trust domain up to maxTrustDomainLen.
+	TrustDomains []string
+}
+
+// NewProxyProtocolListener wraps listener so that it accepts PROXY
+// protocol v1/v2 headers from the given allow-list of source CIDRs.
+func NewProxyProtocolListener(listener net.Listener, service string, allowFrom []*net.IPNet) *ProxyProtocolListener {
+	registerTrustDomainMetrics()
+	return &ProxyProtocolListener{
+		Listener:  listener,
+		Service:   service,
+		AllowFrom: allowFrom,
+	}
+}
+
+func (l *ProxyProtocolListener) allowed(addr net.Addr) bool {
+	host, ok := addr.(*net.TCPAddr)
+	if !ok {
+		return false
+	}
+	for _, cidr := range l.AllowFrom {
+		if cidr.Contains(host.IP) {
+			return true
+		}
+	}
+	return false
+}
+
+// trustDomainAllowed reports whether domain may be used as a trust_domain
+// label value. An empty TrustDomains accepts any (length-capped) value;
+// otherwise domain must appear in the configured set.
+func (l *ProxyProtocolListener) trustDomainAllowed(domain string) bool {
+	if len(l.TrustDomains) == 0 {
+		return true
+	}
+	for _, d := range l.TrustDomains {
+		if d == domain {
+			return true
+		}
+	}
+	return false
+}
+
+// Accept implements net.Listener.
+func (l *ProxyProtocolListener) Accept() (net.Conn, error) {
+	for {
+		conn, err := l.Listener.Accept()
+		if err != nil {
+			return nil, trace.Wrap(err)
+		}
+
+		wrapped, err := l.readHeader(conn)
+		if err != nil {
+			proxyProtocolRejected.WithLabelValues(l.Service).Inc()
+			conn.Close()
+			continue
+		}
+		return wrapped, nil
+	}
+}
+
+// readHeader peeks at the start of conn, and if it carries a PROXY
+// protocol header, parses it and returns a proxyProtocolConn with the
+// recovered addresses and metadata. If conn carries no header it is
+// returned with its peeked bytes intact, whatever its source. If it
+// carries a header from a source not in the allow-list, or a malformed
+// header, an error is returned and the caller must close it.
+//
+// conn is given a bounded read deadline for the duration of this call,
+// since it runs synchronously inside Accept's single accept loop: a
+// client that opens a connection and never sends anything would
+// otherwise block that loop, and every other connection with it, for as
+// long as the client keeps the socket open.
+func (l *ProxyProtocolListener) readHeader(conn net.Conn) (net.Conn, error) {
+	if err := conn.SetReadDeadline(time.Now().Add(headerReadTimeout)); err != nil {
+		return nil, trace.Wrap(err)
+	}
+	defer conn.SetReadDeadline(time.Time{})
+
+	br := bufio.NewReader(conn)
+	prefix, err := br.Peek(12)
+	if err != nil {
+		// Not enough bytes for any PROXY protocol header; treat as a
+		// plain connection.
+		return bufferedConn{Conn: conn, r: br}, nil
+	}
+
+	var isProxyProtocol bool
+	switch {
+	case string(prefix[:5]) == "PROXY":
+		isProxyProtocol = true
+	case string(prefix) == string(proxyProtoV2Sig[:]):
+		isProxyProtocol = true
+	}
+
+	if !isProxyProtocol {
+		return bufferedConn{Conn: conn, r: br}, nil
+	}
+	if !l.allowed(conn.RemoteAddr()) {
+		return nil, trace.AccessDenied("PROXY protocol header not allowed from %v", conn.RemoteAddr())
+	}
+
+	if string(prefix[:5]) == "PROXY" {
+		return parseProxyProtocolV1(bufferedConn{Conn: conn, r: br})
+	}
+
+	wrapped, err := parseProxyProtocolV2(bufferedConn{Conn: conn, r: br})
+	if err != nil {
+		return nil, err
+	}
+	if pc, ok := wrapped.(*proxyProtocolConn); ok && pc.meta.trustDomain != "" && !l.trustDomainAllowed(pc.meta.trustDomain) {
+		pc.meta.trustDomain = ""
+	}
+	return wrapped, nil
+}
+
+// bufferedConn is a net.Conn whose initial reads are served from a
+// bufio.Reader that has already consumed some bytes for header sniffing.
+type bufferedConn struct {
+	net.Conn
+	r *bufio.Reader
+}
+
+func (c bufferedConn) Read(p []byte) (int, error) {
+	return c.r.Read(p)
+}
+
+var proxyProtoV2Sig = [12]byte{0x0D, 0x0A, 0x0D, 0x0A, 0x00, 0x0D, 0x0A, 0x51, 0x55, 0x49, 0x54, 0x0A}
+
+// parseProxyProtocolV1 reads a PROXY protocol v1 (text) header from conn
+// and returns a proxyProtocolConn with the original client address.
+func parseProxyProtocolV1(conn bufferedConn) (net.Conn, error) {
+	line, err := conn.r.ReadString('\n')
+	if err != nil {
+		return nil, trace.Wrap(err)
+	}
+
+	var proto, srcIP, dstIP, srcPort, dstPort string
+	n, err := fmt.Sscanf(line, "PROXY %s %s %s %s %s\r\n", &proto, &srcIP, &dstIP, &srcPort, &dstPort)
+	if err != nil || n != 5 {
+		return nil, trace.BadParameter("malformed PROXY protocol v1 header")
+	}
+
+	remote := &net.TCPAddr{IP: net.ParseIP(srcIP)}
+	fmt.Sscanf(srcPort, "%d", &remote.Port)
+	local := &net.TCPAddr{IP: net.ParseIP(dstIP)}
+	fmt.Sscanf(dstPort, "%d", &local.Port)
+
+	return &proxyProtocolConn{
+		Conn:       conn,
+		remoteAddr: remote,
+		localAddr:  local,
+	}, nil
+}
+
+// parseProxyProtocolV2 reads a PROXY protocol v2 (binary) header from conn,
+// including any TLVs, and returns a proxyProtocolConn with the original
+// client address and recovered Teleport metadata.
+func parseProxyProtocolV2(conn bufferedConn) (net.Conn, error) {
+	header := make([]byte, 16)
+	if _, err := io.ReadFull(conn.r, header); err != nil {
+		return nil, trace.Wrap(err)
+	}
+
+	addrLen := binary.BigEndian.Uint16(header[14:16])
+	body := make([]byte, addrLen)
+	if _, err := io.ReadFull(conn.r, body); err != nil {
+		return nil, trace.Wrap(err)
+	}
+
+	protoFamily := header[13] >> 4
+	var remote, local net.Addr
+	var tlvOffset int
+	switch protoFamily {
+	case 0x1: // AF_INET
+		if len(body) < minAddrLenIPv4 {
+			return nil, trace.BadParameter("PROXY protocol v2 address length %v too short for AF_INET", len(body))
+		}
+		remote = &net.TCPAddr{IP: net.IP(body[0:4]), Port: int(binary.BigEndian.Uint16(body[8:10]))}
+		local = &net.TCPAddr{IP: net.IP(body[4:8]), Port: int(binary.BigEndian.Uint16(body[10:12]))}
+		tlvOffset = 12
+	case 0x2: // AF_INET6
+		if len(body) < minAddrLenIPv6 {
+			return nil, trace.BadParameter("PROXY protocol v2 address length %v too short for AF_INET6", len(body))
+		}
+		remote = &net.TCPAddr{IP: net.IP(body[0:16]), Port: int(binary.BigEndian.Uint16(body[32:34]))}
+		local = &net.TCPAddr{IP: net.IP(body[16:32]), Port: int(binary.BigEndian.Uint16(body[34:36]))}
+		tlvOffset = 36
+	default:
+		return nil, trace.BadParameter("unsupported PROXY protocol v2 address family %v", protoFamily)
+	}
+
+	meta := parseTeleportTLVs(body[tlvOffset:])
+
+	return &proxyProtocolConn{
+		Conn:       conn,
+		remoteAddr: remote,
+		localAddr:  local,
+		meta:       meta,
+	}, nil
+}
+
+// parseTeleportTLVs scans a PROXY protocol v2 TLV block for the
+// Teleport-assigned types this package understands, ignoring any others.
+func parseTeleportTLVs(tlvs []byte) proxyProtocolMeta {
+	var meta proxyProtocolMeta
+	for len(tlvs) >= 3 {
+		typ := tlvs[0]
+		length := binary.BigEndian.Uint16(tlvs[1:3])
+		if int(length) > len(tlvs)-3 {
+			break
+		}
+		value := tlvs[3 : 3+int(length)]
+		switch typ {
+		case tlvTypeIngressPath:
+			meta.ingressPath = string(value)
+		case tlvTypeTrustDomain:
+			if len(value) <= maxTrustDomainLen {
+				meta.trustDomain = string(value)
+			}
+		}
+		tlvs = tlvs[3+int(length):]
+	}
+	return meta
+}
@@ -0,0 +1,313 @@
+/*
+Copyright 2022 Gravitational, Inc.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+	http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package ingress
+
+import (
+	"encoding/binary"
+	"io"
+	"net"
+	"strings"
+	"testing"
+
+	"github.com/prometheus/client_golang/prometheus"
+	prommodel "github.com/prometheus/client_model/go"
+	"github.com/stretchr/testify/require"
+)
+
+func TestParseTeleportTLVs(t *testing.T) {
+	var buf []byte
+	appendTLV := func(typ byte, value string) {
+		buf = append(buf, typ)
+		length := make([]byte, 2)
+		binary.BigEndian.PutUint16(length, uint16(len(value)))
+		buf = append(buf, length...)
+		buf = append(buf, value...)
+	}
+	appendTLV(tlvTypeIngressPath, PathALPN)
+	appendTLV(tlvTypeTrustDomain, "root.example.com")
+	appendTLV(0xFF, "ignored")
+
+	meta := parseTeleportTLVs(buf)
+	require.Equal(t, PathALPN, meta.ingressPath)
+	require.Equal(t, "root.example.com", meta.trustDomain)
+}
+
+// TestParseTeleportTLVsCapsOversizedTrustDomain asserts that a trust
+// domain TLV value longer than maxTrustDomainLen is dropped rather than
+// accepted as-is, so a connection can't use an oversized wire value (the
+// TLV length field allows up to 64KB) to inflate the trust_domain label
+// cardinality on acceptedConnectionsByTrustDomain/
+// activeConnectionsByTrustDomain.
+func TestParseTeleportTLVsCapsOversizedTrustDomain(t *testing.T) {
+	var buf []byte
+	appendTLV := func(typ byte, value string) {
+		buf = append(buf, typ)
+		length := make([]byte, 2)
+		binary.BigEndian.PutUint16(length, uint16(len(value)))
+		buf = append(buf, length...)
+		buf = append(buf, value...)
+	}
+	appendTLV(tlvTypeTrustDomain, strings.Repeat("a", maxTrustDomainLen+1))
+
+	meta := parseTeleportTLVs(buf)
+	require.Empty(t, meta.trustDomain)
+}
+
+func TestProxyProtocolListenerAllowed(t *testing.T) {
+	_, cidr, err := net.ParseCIDR("10.0.0.0/8")
+	require.NoError(t, err)
+
+	l := &ProxyProtocolListener{AllowFrom: []*net.IPNet{cidr}}
+	require.True(t, l.allowed(&net.TCPAddr{IP: net.ParseIP("10.1.2.3")}))
+	require.False(t, l.allowed(&net.TCPAddr{IP: net.ParseIP("192.168.1.1")}))
+}
+
+// TestProxyProtocolListenerAcceptV1 drives Accept over a real TCP
+// connection carrying a v1 (text) header from an allowed source,
+// asserting that the returned conn's RemoteAddr is rewritten to the
+// address the header carries and that bytes sent after the header still
+// arrive intact.
+func TestProxyProtocolListenerAcceptV1(t *testing.T) {
+	_, cidr, err := net.ParseCIDR("127.0.0.1/32")
+	require.NoError(t, err)
+
+	inner, err := net.Listen("tcp", "127.0.0.1:0")
+	require.NoError(t, err)
+	l := NewProxyProtocolListener(inner, "test-v1", []*net.IPNet{cidr})
+	t.Cleanup(func() { l.Close() })
+
+	acceptC := make(chan net.Conn, 1)
+	acceptErrC := make(chan error, 1)
+	go func() {
+		conn, err := l.Accept()
+		acceptC <- conn
+		acceptErrC <- err
+	}()
+
+	client, err := net.Dial("tcp", inner.Addr().String())
+	require.NoError(t, err)
+	t.Cleanup(func() { client.Close() })
+
+	_, err = client.Write([]byte("PROXY TCP4 203.0.113.1 203.0.113.2 11111 22222\r\nhello"))
+	require.NoError(t, err)
+
+	require.NoError(t, <-acceptErrC)
+	accepted := <-acceptC
+	t.Cleanup(func() { accepted.Close() })
+	require.Equal(t, "203.0.113.1:11111", accepted.RemoteAddr().String())
+
+	buf := make([]byte, len("hello"))
+	_, err = io.ReadFull(accepted, buf)
+	require.NoError(t, err)
+	require.Equal(t, "hello", string(buf))
+}
+
+// TestProxyProtocolListenerAcceptPlain drives Accept over a connection
+// that never sends a PROXY protocol header, asserting it is returned
+// unmodified with its bytes intact.
+func TestProxyProtocolListenerAcceptPlain(t *testing.T) {
+	inner, err := net.Listen("tcp", "127.0.0.1:0")
+	require.NoError(t, err)
+	l := NewProxyProtocolListener(inner, "test-plain", nil)
+	t.Cleanup(func() { l.Close() })
+
+	acceptC := make(chan net.Conn, 1)
+	acceptErrC := make(chan error, 1)
+	go func() {
+		conn, err := l.Accept()
+		acceptC <- conn
+		acceptErrC <- err
+	}()
+
+	client, err := net.Dial("tcp", inner.Addr().String())
+	require.NoError(t, err)
+	t.Cleanup(func() { client.Close() })
+
+	const payload = "hello world!"
+	_, err = client.Write([]byte(payload))
+	require.NoError(t, err)
+
+	require.NoError(t, <-acceptErrC)
+	accepted := <-acceptC
+	t.Cleanup(func() { accepted.Close() })
+
+	buf := make([]byte, len(payload))
+	_, err = io.ReadFull(accepted, buf)
+	require.NoError(t, err)
+	require.Equal(t, payload, string(buf))
+}
+
+// TestProxyProtocolListenerRejectsDisallowedHeader drives Accept with a
+// connection from a source outside AllowFrom that sends a PROXY protocol
+// header anyway, asserting it is rejected, proxyProtocolRejected is
+// incremented, and Accept still serves the next, well-behaved connection.
+func TestProxyProtocolListenerRejectsDisallowedHeader(t *testing.T) {
+	_, cidr, err := net.ParseCIDR("10.0.0.0/8")
+	require.NoError(t, err)
+
+	inner, err := net.Listen("tcp", "127.0.0.1:0")
+	require.NoError(t, err)
+	l := NewProxyProtocolListener(inner, "test-reject", []*net.IPNet{cidr})
+	t.Cleanup(func() { l.Close(); proxyProtocolRejected.Reset() })
+
+	require.Equal(t, 0, getProxyProtocolRejectedCount(t, "test-reject"))
+
+	bad, err := net.Dial("tcp", inner.Addr().String())
+	require.NoError(t, err)
+	t.Cleanup(func() { bad.Close() })
+	_, err = bad.Write([]byte("PROXY TCP4 203.0.113.1 203.0.113.2 11111 22222\r\n"))
+	require.NoError(t, err)
+
+	good, err := net.Dial("tcp", inner.Addr().String())
+	require.NoError(t, err)
+	t.Cleanup(func() { good.Close() })
+	const payload = "hello world!"
+	_, err = good.Write([]byte(payload))
+	require.NoError(t, err)
+
+	accepted, err := l.Accept()
+	require.NoError(t, err)
+	t.Cleanup(func() { accepted.Close() })
+
+	buf := make([]byte, len(payload))
+	_, err = io.ReadFull(accepted, buf)
+	require.NoError(t, err)
+	require.Equal(t, payload, string(buf))
+
+	require.Equal(t, 1, getProxyProtocolRejectedCount(t, "test-reject"))
+}
+
+// TestProxyProtocolListenerTruncatedV2Address drives Accept with a v2
+// header whose wire-supplied address length is too short for its
+// declared address family, asserting the connection is rejected with an
+// error rather than panicking while slicing the address block, and that
+// Accept's single accept loop survives to serve the next connection.
+func TestProxyProtocolListenerTruncatedV2Address(t *testing.T) {
+	_, cidr, err := net.ParseCIDR("127.0.0.1/32")
+	require.NoError(t, err)
+
+	inner, err := net.Listen("tcp", "127.0.0.1:0")
+	require.NoError(t, err)
+	l := NewProxyProtocolListener(inner, "test-v2-truncated", []*net.IPNet{cidr})
+	t.Cleanup(func() { l.Close(); proxyProtocolRejected.Reset() })
+
+	bad, err := net.Dial("tcp", inner.Addr().String())
+	require.NoError(t, err)
+	t.Cleanup(func() { bad.Close() })
+
+	header := append([]byte{}, proxyProtoV2Sig[:]...)
+	header = append(header, 0x21, 0x11) // version 2, PROXY command; AF_INET, TCP
+	addrLen := make([]byte, 2)
+	binary.BigEndian.PutUint16(addrLen, 5) // too short for AF_INET's 12-byte address block
+	header = append(header, addrLen...)
+	header = append(header, make([]byte, 5)...)
+	_, err = bad.Write(header)
+	require.NoError(t, err)
+
+	good, err := net.Dial("tcp", inner.Addr().String())
+	require.NoError(t, err)
+	t.Cleanup(func() { good.Close() })
+	const payload = "hello world!"
+	_, err = good.Write([]byte(payload))
+	require.NoError(t, err)
+
+	accepted, err := l.Accept()
+	require.NoError(t, err)
+	t.Cleanup(func() { accepted.Close() })
+
+	buf := make([]byte, len(payload))
+	_, err = io.ReadFull(accepted, buf)
+	require.NoError(t, err)
+	require.Equal(t, payload, string(buf))
+
+	require.Equal(t, 1, getProxyProtocolRejectedCount(t, "test-v2-truncated"))
+}
+
+// buildProxyProtocolV2Header builds a minimal, valid v2 header over an
+// AF_INET address block, optionally carrying a trust domain TLV.
+func buildProxyProtocolV2Header(t *testing.T, trustDomain string) []byte {
+	t.Helper()
+
+	addr := make([]byte, minAddrLenIPv4)
+	copy(addr[0:4], net.ParseIP("203.0.113.1").To4())
+	copy(addr[4:8], net.ParseIP("203.0.113.2").To4())
+	binary.BigEndian.PutUint16(addr[8:10], 11111)
+	binary.BigEndian.PutUint16(addr[10:12], 22222)
+
+	body := append([]byte{}, addr...)
+	if trustDomain != "" {
+		body = append(body, tlvTypeTrustDomain)
+		length := make([]byte, 2)
+		binary.BigEndian.PutUint16(length, uint16(len(trustDomain)))
+		body = append(body, length...)
+		body = append(body, trustDomain...)
+	}
+
+	header := append([]byte{}, proxyProtoV2Sig[:]...)
+	header = append(header, 0x21, 0x11) // version 2, PROXY command; AF_INET, TCP
+	addrLen := make([]byte, 2)
+	binary.BigEndian.PutUint16(addrLen, uint16(len(body)))
+	header = append(header, addrLen...)
+	header = append(header, body...)
+	return header
+}
+
+// TestProxyProtocolListenerTrustDomainAllowList asserts that a v2
+// header's trust domain TLV is dropped when TrustDomains is configured
+// and the value isn't in it, so a source within AllowFrom can't mint
+// unbounded trust_domain label values by sending an arbitrary trust
+// domain per connection.
+func TestProxyProtocolListenerTrustDomainAllowList(t *testing.T) {
+	_, cidr, err := net.ParseCIDR("127.0.0.1/32")
+	require.NoError(t, err)
+
+	inner, err := net.Listen("tcp", "127.0.0.1:0")
+	require.NoError(t, err)
+	l := NewProxyProtocolListener(inner, "test-trust-domain", []*net.IPNet{cidr})
+	l.TrustDomains = []string{"root.example.com"}
+	t.Cleanup(func() { l.Close() })
+
+	acceptC := make(chan net.Conn, 1)
+	acceptErrC := make(chan error, 1)
+	go func() {
+		conn, err := l.Accept()
+		acceptC <- conn
+		acceptErrC <- err
+	}()
+
+	client, err := net.Dial("tcp", inner.Addr().String())
+	require.NoError(t, err)
+	t.Cleanup(func() { client.Close() })
+
+	_, err = client.Write(buildProxyProtocolV2Header(t, "spoofed.example.com"))
+	require.NoError(t, err)
+
+	require.NoError(t, <-acceptErrC)
+	accepted := <-acceptC
+	t.Cleanup(func() { accepted.Close() })
+
+	pc, ok := accepted.(*proxyProtocolConn)
+	require.True(t, ok)
+	require.Empty(t, pc.meta.trustDomain)
+}
+
+func getProxyProtocolRejectedCount(t *testing.T, service string) int {
+	t.Helper()
+	m := &prommodel.Metric{}
+	require.NoError(t, proxyProtocolRejected.WithLabelValues(service).(prometheus.Metric).Write(m))
+	return int(m.Counter.GetValue())
+}
@@ -0,0 +1,321 @@
+/*
+Copyright 2022 Gravitational, Inc.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+	http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+// Package ingress tracks connections accepted by Teleport's public facing
+// listeners, classifying them by the path a client used to reach the
+// service (e.g. direct TLS, ALPN-routed through the multiplexer) so
+// operators can see how traffic actually arrives at the cluster.
+package ingress
+
+import (
+	"net"
+	"net/http"
+	"sync"
+
+	"github.com/prometheus/client_golang/prometheus"
+
+	"github.com/gravitational/teleport/lib/utils"
+)
+
+// Service identifies the Teleport service a connection was accepted for.
+const (
+	SSH = "ssh"
+	Web = "web"
+)
+
+// Path identifies how a connection reached a listener.
+const (
+	// PathDirect is used for connections accepted on a service's own,
+	// non-multiplexed listener.
+	PathDirect = "direct"
+	// PathALPN is used for connections accepted on the multiplexed web
+	// listener and routed by their ALPN protocol.
+	PathALPN = "alpn"
+	// PathUnknown is used when the ingress path could not be determined.
+	PathUnknown = "unknown"
+)
+
+var (
+	acceptedConnections = prometheus.NewCounterVec(
+		prometheus.CounterOpts{
+			Name: "teleport_connections_accepted_total",
+			Help: "Number of connections accepted by Teleport, by ingress path and service",
+		},
+		[]string{"path", "service"},
+	)
+	activeConnections = prometheus.NewGaugeVec(
+		prometheus.GaugeOpts{
+			Name: "teleport_connections_active",
+			Help: "Number of currently active connections, by ingress path and service",
+		},
+		[]string{"path", "service"},
+	)
+	authenticatedConnectionsAccepted = prometheus.NewCounterVec(
+		prometheus.CounterOpts{
+			Name: "teleport_authenticated_connections_accepted_total",
+			Help: "Number of connections that completed authentication, by ingress path and service",
+		},
+		[]string{"path", "service"},
+	)
+	authenticatedConnectionsActive = prometheus.NewGaugeVec(
+		prometheus.GaugeOpts{
+			Name: "teleport_authenticated_connections_active",
+			Help: "Number of currently active authenticated connections, by ingress path and service",
+		},
+		[]string{"path", "service"},
+	)
+)
+
+func init() {
+	prometheus.MustRegister(
+		acceptedConnections,
+		activeConnections,
+		authenticatedConnectionsAccepted,
+		authenticatedConnectionsActive,
+	)
+}
+
+// Reporter tracks connection counts by the ingress path they arrived
+// through. It is safe for concurrent use.
+type Reporter struct {
+	// sshAddr is the address of the SSH service's direct listener. It is
+	// validated at construction so a misconfigured address is caught
+	// early, even though every non-ALPN port is already classified
+	// PathDirect without needing to match it.
+	sshAddr *utils.NetAddr
+
+	// pathDetectors are consulted, in order, before falling back to
+	// port-based classification. The first detector to return ok=true
+	// wins.
+	pathDetectors []func(net.Conn) (string, bool)
+
+	// limits are the caps and rates Admit enforces. The zero value
+	// enforces nothing, so Admit always succeeds and behaves exactly
+	// like ConnectionAccepted.
+	limits Limits
+
+	// pathCounters holds one atomic counter per path named in
+	// limits.MaxConcurrentPerPath, built once at construction so Admit
+	// only ever reads the map and updates counters atomically, without a
+	// lock on the hot path.
+	pathCounters map[string]*int64
+	// pathLimiters lazily holds one *rate.Limiter per path seen by
+	// Admit, used when limits.AcceptRate is configured.
+	pathLimiters sync.Map
+
+	// remoteIPs tracks per-remote-IP concurrency and rate limit state,
+	// sharded to keep Admit/Release off a single lock on the hot path.
+	remoteIPs *ipShardedMap
+
+	closeSweeper func()
+}
+
+// ReporterOption configures optional Reporter behavior.
+type ReporterOption func(*Reporter)
+
+// WithPathDetector registers detector as an additional way to classify a
+// connection's ingress path, consulted before the built-in port-based
+// rules. It lets callers such as the reverse tunnel server teach the
+// Reporter about paths it has no listener-port knowledge of.
+func WithPathDetector(detector func(net.Conn) (string, bool)) ReporterOption {
+	return func(r *Reporter) {
+		r.pathDetectors = append(r.pathDetectors, detector)
+	}
+}
+
+// NewReporter returns a Reporter, validating sshAddr as the address of
+// the SSH service's direct listener if one is given. sshAddr may be
+// empty if the SSH service has no direct listener.
+func NewReporter(sshAddr string, opts ...ReporterOption) (*Reporter, error) {
+	r := &Reporter{closeSweeper: func() {}}
+	if sshAddr != "" {
+		addr, err := utils.ParseAddr(sshAddr)
+		if err != nil {
+			return nil, err
+		}
+		r.sshAddr = addr
+	}
+	for _, opt := range opts {
+		opt(r)
+	}
+	registerThroughputMetrics(DefaultReporterConfig())
+	registerLimitMetrics()
+	return r, nil
+}
+
+// Close stops the background sweeper WithLimits started to expire idle
+// per-remote-IP state, if one is running. It is safe to call on a
+// Reporter constructed without WithLimits, and safe to call more than
+// once.
+func (r *Reporter) Close() error {
+	r.closeSweeper()
+	return nil
+}
+
+// unwrappableConn is implemented by connection wrappers, such as
+// countingConn, that embed another net.Conn and want getIngressPath,
+// trustDomain and path detectors like ReverseTunnelReporter.PathDetector
+// to see through them to the connection underneath, rather than silently
+// losing whatever that connection's concrete type would have told them.
+type unwrappableConn interface {
+	Unwrap() net.Conn
+}
+
+// unwrapConn peels back successive layers of unwrappableConn wrapping
+// conn, returning the innermost connection it finds. Wrappers that
+// aren't themselves unwrappableConn, such as *proxyProtocolConn and
+// *tunnelConn, mark the bottom of the chain.
+func unwrapConn(conn net.Conn) net.Conn {
+	for {
+		u, ok := conn.(unwrappableConn)
+		if !ok {
+			return conn
+		}
+		conn = u.Unwrap()
+	}
+}
+
+// getIngressPath classifies conn by the local address it was accepted on,
+// unless it arrived with a PROXY protocol header carrying a Teleport
+// ingress path TLV, or one of the Reporter's registered path detectors
+// recognizes it, either of which take precedence. Port 3080 is the
+// ALPN-multiplexed web listener; every other resolvable port, including
+// the SSH service's own direct listener, is a non-multiplexed direct
+// connection.
+func (r *Reporter) getIngressPath(conn net.Conn) string {
+	unwrapped := unwrapConn(conn)
+
+	if pc, ok := unwrapped.(*proxyProtocolConn); ok {
+		if pc.meta.ingressPath != "" {
+			return pc.meta.ingressPath
+		}
+		return PathProxyProtocol
+	}
+
+	for _, detect := range r.pathDetectors {
+		if path, ok := detect(unwrapped); ok {
+			return path
+		}
+	}
+
+	addr, err := utils.ParseAddr(conn.LocalAddr().String())
+	if err != nil {
+		return PathUnknown
+	}
+	switch addr.Port(-1) {
+	case 3080:
+		return PathALPN
+	case -1:
+		// No port could be resolved at all, as opposed to a port that
+		// simply isn't 3080; there's nothing left to classify by.
+		return PathUnknown
+	default:
+		return PathDirect
+	}
+}
+
+// trustDomain returns the PROXY protocol trust domain TLV carried by conn,
+// if any.
+func trustDomain(conn net.Conn) (string, bool) {
+	pc, ok := unwrapConn(conn).(*proxyProtocolConn)
+	if !ok || pc.meta.trustDomain == "" {
+		return "", false
+	}
+	return pc.meta.trustDomain, true
+}
+
+// ConnectionAccepted records conn as accepted for service.
+func (r *Reporter) ConnectionAccepted(service string, conn net.Conn) {
+	path := r.getIngressPath(conn)
+	acceptedConnections.WithLabelValues(path, service).Inc()
+	activeConnections.WithLabelValues(path, service).Inc()
+	if td, ok := trustDomain(conn); ok {
+		acceptedConnectionsByTrustDomain.WithLabelValues(path, service, td).Inc()
+		activeConnectionsByTrustDomain.WithLabelValues(path, service, td).Inc()
+	}
+}
+
+// ConnectionClosed records that a previously accepted connection for
+// service has closed.
+func (r *Reporter) ConnectionClosed(service string, conn net.Conn) {
+	path := r.getIngressPath(conn)
+	activeConnections.WithLabelValues(path, service).Dec()
+	if td, ok := trustDomain(conn); ok {
+		activeConnectionsByTrustDomain.WithLabelValues(path, service, td).Dec()
+	}
+}
+
+// ConnectionAuthenticated records that conn completed authentication for
+// service.
+func (r *Reporter) ConnectionAuthenticated(service string, conn net.Conn) {
+	path := r.getIngressPath(conn)
+	authenticatedConnectionsAccepted.WithLabelValues(path, service).Inc()
+	authenticatedConnectionsActive.WithLabelValues(path, service).Inc()
+}
+
+// AuthenticatedConnectionClosed records that a previously authenticated
+// connection for service has closed.
+func (r *Reporter) AuthenticatedConnectionClosed(service string, conn net.Conn) {
+	path := r.getIngressPath(conn)
+	authenticatedConnectionsActive.WithLabelValues(path, service).Dec()
+}
+
+// HTTPConnStateReporter returns an http.Server ConnState callback that
+// drives reporter's counters for HTTP listeners, where every accepted
+// connection is considered authenticated once the HTTP handshake
+// completes (TLS client auth, if any, has already happened by StateNew).
+// If the server's Listener was wrapped with reporter.WrapListener, conn
+// is already a throughput-tracking shim; on StateNew it is marked
+// authenticated so its eventual duration metric carries
+// authenticated="true", giving the server byte and latency metrics for
+// free with no further handler-side code.
+//
+// On StateNew the connection is run through reporter.Admit rather than
+// ConnectionAccepted: if reporter's configured limits reject it, it is
+// closed immediately, before the server reads a single byte of the
+// request, and StateClosed skips the counters Admit never incremented
+// for it.
+func HTTPConnStateReporter(service string, reporter *Reporter) func(net.Conn, http.ConnState) {
+	var mu sync.Mutex
+	admitted := make(map[net.Conn]bool)
+
+	return func(conn net.Conn, state http.ConnState) {
+		switch state {
+		case http.StateNew:
+			if err := reporter.Admit(service, conn); err != nil {
+				conn.Close()
+				return
+			}
+			mu.Lock()
+			admitted[conn] = true
+			mu.Unlock()
+			reporter.ConnectionAuthenticated(service, conn)
+			if a, ok := conn.(authenticator); ok {
+				a.SetAuthenticated()
+			}
+		case http.StateClosed, http.StateHijacked:
+			mu.Lock()
+			ok := admitted[conn]
+			delete(admitted, conn)
+			mu.Unlock()
+			if !ok {
+				return
+			}
+			reporter.AuthenticatedConnectionClosed(service, conn)
+			reporter.Release(service, conn)
+		}
+	}
+}
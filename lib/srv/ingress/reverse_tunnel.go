@@ -0,0 +1,170 @@
+/*
+Copyright 2022 Gravitational, Inc.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+	http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package ingress
+
+import (
+	"net"
+	"sync"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus"
+)
+
+// PathReverseTunnel is used for connections that the proxy receives by
+// accepting an inbound dial from an agent's reverse tunnel, rather than a
+// client connecting directly to one of the proxy's own listeners.
+const PathReverseTunnel = "reverse_tunnel"
+
+var (
+	reverseTunnelSessionsActive = prometheus.NewGaugeVec(
+		prometheus.GaugeOpts{
+			Name: "teleport_reverse_tunnel_sessions_active",
+			Help: "Number of reverse tunnel sessions currently connected, by cluster and agent",
+		},
+		[]string{"cluster", "agent_id"},
+	)
+	reverseTunnelMultiplexedStreamsActive = prometheus.NewGauge(
+		prometheus.GaugeOpts{
+			Name: "teleport_reverse_tunnel_multiplexed_streams_active",
+			Help: "Number of multiplexed streams currently open across all reverse tunnel sessions",
+		},
+	)
+	reverseTunnelStreamSetupSeconds = prometheus.NewHistogram(
+		prometheus.HistogramOpts{
+			Name:    "teleport_reverse_tunnel_stream_setup_seconds",
+			Help:    "Time taken to establish a multiplexed stream over a reverse tunnel session",
+			Buckets: prometheus.DefBuckets,
+		},
+	)
+)
+
+func init() {
+	prometheus.MustRegister(
+		reverseTunnelSessionsActive,
+		reverseTunnelMultiplexedStreamsActive,
+		reverseTunnelStreamSetupSeconds,
+	)
+}
+
+// ReverseTunnelReporter tracks the reverse tunnel sessions agents have
+// opened back to the proxy, and the multiplexed streams carried over
+// them, in addition to the connection counts Reporter already tracks.
+type ReverseTunnelReporter struct {
+	*Reporter
+}
+
+// NewReverseTunnelReporter returns a ReverseTunnelReporter that delegates
+// plain connection accounting to reporter.
+func NewReverseTunnelReporter(reporter *Reporter) *ReverseTunnelReporter {
+	return &ReverseTunnelReporter{Reporter: reporter}
+}
+
+// PathDetector returns a detector, suitable for WithPathDetector, that
+// classifies conn as PathReverseTunnel. It is meant to be passed to
+// NewReporter via WithPathDetector by the reverse tunnel server, which
+// knows a connection arrived over a tunnel before the Reporter would.
+func (r *ReverseTunnelReporter) PathDetector() func(net.Conn) (string, bool) {
+	return func(conn net.Conn) (string, bool) {
+		_, ok := unwrapConn(conn).(*tunnelConn)
+		return PathReverseTunnel, ok
+	}
+}
+
+// tunnelConn marks a net.Conn as having been opened by an agent dialing
+// back to the proxy, so the Reporter's path detector can recognize it.
+type tunnelConn struct {
+	net.Conn
+}
+
+// WrapTunnelConn marks conn as a reverse tunnel connection so it is
+// reported under PathReverseTunnel.
+func WrapTunnelConn(conn net.Conn) net.Conn {
+	return &tunnelConn{Conn: conn}
+}
+
+// SessionOpened records that an agent from cluster has established a
+// reverse tunnel session.
+func (r *ReverseTunnelReporter) SessionOpened(cluster, agentID string) {
+	reverseTunnelSessionsActive.WithLabelValues(cluster, agentID).Inc()
+}
+
+// SessionClosed records that a previously established reverse tunnel
+// session has torn down.
+func (r *ReverseTunnelReporter) SessionClosed(cluster, agentID string) {
+	reverseTunnelSessionsActive.WithLabelValues(cluster, agentID).Dec()
+}
+
+// TunnelConnState describes a transition in the lifecycle of a
+// multiplexed stream carried over a reverse tunnel session, mirroring the
+// handshake/teardown states exposed by the yamux/mux session underneath
+// the tunnel.
+type TunnelConnState int
+
+const (
+	// TunnelSYN is reported when a new multiplexed stream is opened over
+	// the tunnel, before it has completed its handshake.
+	TunnelSYN TunnelConnState = iota
+	// TunnelEstablished is reported once the stream's handshake completes
+	// and it is ready to carry traffic.
+	TunnelEstablished
+	// TunnelFIN is reported when a stream closes cleanly.
+	TunnelFIN
+	// TunnelRST is reported when a stream is aborted.
+	TunnelRST
+)
+
+// TunnelConnStateReporter returns a callback, analogous to
+// HTTPConnStateReporter, that a reverse tunnel server's mux/yamux session
+// can invoke on every stream state transition to keep reporter's
+// multiplexed stream gauge and setup-time histogram up to date.
+func TunnelConnStateReporter(reporter *ReverseTunnelReporter) func(net.Conn, TunnelConnState) {
+	type streamState struct {
+		opened      time.Time
+		established bool
+	}
+	var mu sync.Mutex
+	streams := make(map[net.Conn]*streamState)
+
+	return func(conn net.Conn, state TunnelConnState) {
+		switch state {
+		case TunnelSYN:
+			mu.Lock()
+			streams[conn] = &streamState{opened: time.Now()}
+			mu.Unlock()
+		case TunnelEstablished:
+			mu.Lock()
+			s, ok := streams[conn]
+			first := ok && !s.established
+			if first {
+				s.established = true
+			}
+			mu.Unlock()
+			if first {
+				reverseTunnelStreamSetupSeconds.Observe(time.Since(s.opened).Seconds())
+				reverseTunnelMultiplexedStreamsActive.Inc()
+			}
+		case TunnelFIN, TunnelRST:
+			mu.Lock()
+			s, ok := streams[conn]
+			delete(streams, conn)
+			mu.Unlock()
+			if ok && s.established {
+				reverseTunnelMultiplexedStreamsActive.Dec()
+			}
+		}
+	}
+}
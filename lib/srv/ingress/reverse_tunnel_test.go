@@ -0,0 +1,69 @@
+/*
+Copyright 2022 Gravitational, Inc.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+	http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package ingress
+
+import (
+	"net"
+	"testing"
+
+	"github.com/prometheus/client_golang/prometheus"
+	prommodel "github.com/prometheus/client_model/go"
+	"github.com/stretchr/testify/require"
+)
+
+func TestTunnelConnStateReporter(t *testing.T) {
+	t.Cleanup(func() {
+		reverseTunnelMultiplexedStreamsActive.Set(0)
+	})
+
+	reporter, err := NewReporter("")
+	require.NoError(t, err)
+	tunnelReporter := NewReverseTunnelReporter(reporter)
+	reportState := TunnelConnStateReporter(tunnelReporter)
+
+	conn := &tunnelConn{Conn: &net.TCPConn{}}
+
+	reportState(conn, TunnelSYN)
+	require.Equal(t, float64(0), getGaugeValueNoLabels(reverseTunnelMultiplexedStreamsActive))
+
+	reportState(conn, TunnelEstablished)
+	require.Equal(t, float64(1), getGaugeValueNoLabels(reverseTunnelMultiplexedStreamsActive))
+
+	reportState(conn, TunnelFIN)
+	require.Equal(t, float64(0), getGaugeValueNoLabels(reverseTunnelMultiplexedStreamsActive))
+}
+
+func TestReverseTunnelPathDetector(t *testing.T) {
+	reporter, err := NewReporter("")
+	require.NoError(t, err)
+	tunnelReporter := NewReverseTunnelReporter(reporter)
+
+	path, ok := tunnelReporter.PathDetector()(WrapTunnelConn(&net.TCPConn{}))
+	require.True(t, ok)
+	require.Equal(t, PathReverseTunnel, path)
+
+	_, ok = tunnelReporter.PathDetector()(&net.TCPConn{})
+	require.False(t, ok)
+}
+
+func getGaugeValueNoLabels(g prometheus.Gauge) float64 {
+	var m prommodel.Metric
+	if err := g.Write(&m); err != nil {
+		return 0
+	}
+	return m.Gauge.GetValue()
+}